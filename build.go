@@ -0,0 +1,128 @@
+package kodos
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// node tracks the build state of a single Package within a BuildPackages
+// run: a channel that is closed once the package (and everything above it
+// in the DAG) has been attempted, and the error that resulted, if any.
+type node struct {
+	done chan struct{}
+	err  error
+}
+
+// builder schedules Packages for compilation in dependency order, bounded
+// by a worker pool sized to the owning Context's njobs().
+type builder struct {
+	mu    sync.Mutex
+	nodes map[*Package]*node
+	sem   chan struct{}
+}
+
+// start ensures pkg (and, transitively, everything it imports) is
+// scheduled exactly once, and returns the node tracking its completion.
+func (b *builder) start(pkg *Package) *node {
+	b.mu.Lock()
+	if n, ok := b.nodes[pkg]; ok {
+		b.mu.Unlock()
+		return n
+	}
+	n := &node{done: make(chan struct{})}
+	b.nodes[pkg] = n
+	b.mu.Unlock()
+
+	go b.build(pkg, n)
+	return n
+}
+
+// build waits for pkg's imports to finish, then compiles pkg itself
+// unless a dependency failed or pkg is already up to date.
+func (b *builder) build(pkg *Package, n *node) {
+	defer close(n.done)
+
+	deps := make([]*node, len(pkg.Imports))
+	for i, imp := range pkg.Imports {
+		deps[i] = b.start(imp)
+	}
+	for i, dep := range deps {
+		<-dep.done
+		if dep.err != nil {
+			n.err = fmt.Errorf("%s: dependency %s did not compile: %v", pkg.ImportPath, pkg.Imports[i].ImportPath, dep.err)
+			return
+		}
+	}
+
+	switch pkg.ImportPath {
+	case "C", "unsafe":
+		// synthetic packages, nothing to compile
+		return
+	}
+
+	if pkg.NotStale {
+		return
+	}
+
+	b.sem <- struct{}{}
+	defer func() { <-b.sem }()
+
+	if err := pkg.Compile(); err != nil {
+		n.err = fmt.Errorf("compile %s: %v", pkg.ImportPath, err)
+	}
+}
+
+// BuildPackages compiles every stale package reachable from pkgs via
+// Package.Imports, and returns a function that links the command (Main)
+// packages among pkgs.
+//
+// Compilation is scheduled as a DAG: a package is only submitted to the
+// worker pool, sized to the Context's njobs() (runtime.NumCPU() by
+// default), once all of its imports have compiled successfully. A
+// failure fails that package's dependents in turn, but independent
+// subtrees keep building to completion rather than aborting the whole
+// run. Each package's compiler output is buffered and flushed as a
+// single write so concurrent compiles don't interleave their logs.
+//
+// The returned function is nil if any package failed to build.
+func BuildPackages(pkgs ...*Package) (func() error, error) {
+	njobs := runtime.NumCPU()
+	if len(pkgs) > 0 {
+		njobs = pkgs[0].njobs()
+	}
+
+	b := &builder{
+		nodes: make(map[*Package]*node),
+		sem:   make(chan struct{}, njobs),
+	}
+
+	nodes := make([]*node, len(pkgs))
+	for i, pkg := range pkgs {
+		nodes[i] = b.start(pkg)
+	}
+
+	var errs []string
+	for _, n := range nodes {
+		<-n.done
+		if n.err != nil {
+			errs = append(errs, n.err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("build failed:\n%s", strings.Join(errs, "\n"))
+	}
+
+	return func() error {
+		for _, pkg := range pkgs {
+			if !pkg.Main {
+				continue
+			}
+			if err := pkg.Link(); err != nil {
+				return fmt.Errorf("link %s: %v", pkg.ImportPath, err)
+			}
+		}
+		return nil
+	}, nil
+}
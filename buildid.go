@@ -0,0 +1,80 @@
+package kodos
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// buildID returns a content hash identifying this package's compiled
+// output, combining the sha1 of its sorted source file contents, the
+// buildIDs of its direct imports, ctxString() (GOOS/GOARCH, build tags)
+// and the race, gcflags and ldflags settings. Two builds that agree on buildID are guaranteed to
+// produce the same .a, regardless of what the filesystem's mtimes say.
+//
+// The result is memoised on pkg, since the same *Package is shared by
+// every package that imports it.
+func (pkg *Package) buildID() (string, error) {
+	if pkg.cachedBuildID != "" {
+		return pkg.cachedBuildID, nil
+	}
+
+	h := sha1.New()
+	fmt.Fprintln(h, pkg.ctxString(), pkg.race, pkg.gcflags, pkg.ldflags)
+
+	files := append([]string(nil), pkg.files()...)
+	sort.Strings(files)
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(pkg.Dir, f))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(h, f)
+		h.Write(data)
+	}
+
+	imports := append([]*Package(nil), pkg.Imports...)
+	sort.Slice(imports, func(i, j int) bool { return imports[i].ImportPath < imports[j].ImportPath })
+	for _, imp := range imports {
+		id, err := imp.buildID()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(h, imp.ImportPath, id)
+	}
+
+	id := hex.EncodeToString(h.Sum(nil))
+	pkg.cachedBuildID = id
+	return id, nil
+}
+
+// buildIDPath returns the sidecar file next to pkgpath() that records the
+// buildID of the .a currently installed there.
+func (pkg *Package) buildIDPath() string {
+	return pkg.pkgpath() + ".buildid"
+}
+
+// storedBuildID returns the buildID recorded the last time this package
+// was compiled, if any.
+func (pkg *Package) storedBuildID() (string, bool) {
+	data, err := ioutil.ReadFile(pkg.buildIDPath())
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+// writeBuildID computes pkg's current buildID and records it in the
+// sidecar file, so a future IsStale can tell this exact build apart from
+// one with different source or dependencies.
+func (pkg *Package) writeBuildID() error {
+	id, err := pkg.buildID()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pkg.buildIDPath(), []byte(id), 0644)
+}
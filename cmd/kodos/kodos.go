@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/sha1"
 	"flag"
 	"fmt"
 	"go/build"
@@ -41,28 +40,63 @@ func main() {
 	pkgdir := filepath.Join(dir, ".kodos", "pkg")
 
 	ctx := &kodos.Context{
-		GOOS:    runtime.GOOS,
-		GOARCH:  runtime.GOARCH,
+		GOOS:    envOr("GOOS", runtime.GOOS),
+		GOARCH:  envOr("GOARCH", runtime.GOARCH),
 		Workdir: workdir,
 		Pkgdir:  pkgdir,
 		Bindir:  dir,
 	}
 
 	action := "build"
+	if args := flag.Args(); len(args) > 0 {
+		action = args[0]
+	}
 	prefix := "github.com/constabulary/kodos"
 
+	resolver := kodos.ChainResolvers{
+		kodos.NewSourceResolver(ctx, prefix, dir),
+		kodos.NewVendorResolver(ctx, dir),
+		kodos.NewGOPATHResolver(ctx),
+		kodos.NewGorootResolver(ctx),
+	}
+
 	switch action {
 	case "build":
-		srcs := loadSources(prefix, dir)
+		srcs := loadSources(ctx, prefix, dir)
 		for _, src := range srcs {
 			fmt.Printf("loaded %s (%s)\n", src.ImportPath, src.Name)
 		}
 
-		srcs = loadDependencies(dir, srcs...)
+		srcs = loadDependencies(ctx, resolver, srcs...)
 		pkgs := ctx.Transform(srcs...)
 		fn, err := kodos.BuildPackages(pkgs...)
 		check(err)
 		check(fn())
+	case "test":
+		srcs := loadSources(ctx, prefix, dir)
+		for _, src := range srcs {
+			fmt.Printf("loaded %s (%s)\n", src.ImportPath, src.Name)
+		}
+
+		roots := make(map[string]bool, len(srcs))
+		for _, src := range srcs {
+			roots[src.ImportPath] = true
+		}
+
+		srcs = loadTestDependencies(ctx, resolver, srcs...)
+		pkgs := ctx.Transform(srcs...)
+
+		var rootpkgs []*kodos.Package
+		for _, pkg := range pkgs {
+			if roots[pkg.ImportPath] {
+				rootpkgs = append(rootpkgs, pkg)
+			}
+		}
+
+		tests := ctx.TransformTests(pkgs, rootpkgs...)
+		fn, err := kodos.BuildTests(tests...)
+		check(err)
+		check(fn())
 	default:
 		fatal("unknown action:", action)
 	}
@@ -74,6 +108,15 @@ func cwd() string {
 	return wd
 }
 
+// envOr returns the value of the named environment variable, or def if
+// it is unset or empty.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
 // findreporoot returns the location of the closest .git directory
 // relative to the dir provided.
 func findreporoot(dir string) (string, error) {
@@ -96,7 +139,7 @@ func findreporoot(dir string) (string, error) {
 	}
 }
 
-func loadSources(prefix string, dir string) []*build.Package {
+func loadSources(ctx *kodos.Context, prefix string, dir string) []*build.Package {
 	f, err := os.Open(dir)
 	check(err)
 	files, err := f.Readdir(-1)
@@ -111,11 +154,11 @@ func loadSources(prefix string, dir string) []*build.Package {
 			continue
 		}
 		if fi.IsDir() {
-			srcs = append(srcs, loadSources(path.Join(prefix, name), filepath.Join(dir, name))...)
+			srcs = append(srcs, loadSources(ctx, path.Join(prefix, name), filepath.Join(dir, name))...)
 		}
 	}
 
-	pkg, err := build.ImportDir(dir, 0)
+	pkg, err := ctx.ImportDir(dir)
 	switch err := err.(type) {
 	case nil:
 		// ImportDir does not know the import path for this package
@@ -131,66 +174,127 @@ func loadSources(prefix string, dir string) []*build.Package {
 	return srcs
 }
 
-func loadDependencies(rootdir string, srcs ...*build.Package) []*build.Package {
-	load := func(path string) *build.Package {
-		dir := filepath.Join(runtime.GOROOT(), "src", path)
-		if _, err := os.Stat(dir); err != nil {
-			fatal("cannot resolve path ", path, err.Error())
+// walkImports walks the import paths importsOf returns for each package
+// in roots (and, transitively, everything those resolve to in turn) and
+// appends the *build.Package for each new one to srcs, resolving every
+// import path through resolver: a relative ("./foo") import is rewritten
+// to a synthetic "_/abs/path" import rooted at the importing package's
+// directory and loaded directly; anything else is handed to resolver,
+// which is free to look in the repo's own source tree, a vendor
+// directory, GOROOT, or anywhere else a kodos.Resolver chooses to. seen
+// must already hold every ImportPath present in srcs.
+func walkImports(ctx *kodos.Context, resolver kodos.Resolver, seen map[string]bool, srcs, roots []*build.Package, importsOf func(*build.Package) []string) []*build.Package {
+	// rewrite relative imports in each loaded package's own import lists
+	// too, so that lookups by import path (eg. Context.Transform) find the
+	// "_/abs/path" package walk loads for them.
+	rewriteImports := func(pkg *build.Package) {
+		for _, imports := range [][]string{pkg.Imports, pkg.TestImports, pkg.XTestImports} {
+			for i, path := range imports {
+				imports[i] = rewriteRelativeImport(pkg.Dir, path)
+			}
 		}
-		return importPath(path, dir)
 	}
-
-	seen := make(map[string]bool)
-	var walk func(string)
-	walk = func(path string) {
+	var walk func(fromDir, path string)
+	walk = func(fromDir, path string) {
+		path = rewriteRelativeImport(fromDir, path)
 		if seen[path] {
 			return
 		}
 		seen[path] = true
-		pkg := load(path)
+		pkg, err := resolveImport(ctx, resolver, fromDir, path)
+		check(err)
+		rewriteImports(pkg)
 		srcs = append(srcs, pkg)
 		for _, i := range pkg.Imports {
-			walk(i)
+			walk(pkg.Dir, i)
+		}
+	}
+	for _, root := range roots {
+		rewriteImports(root)
+		for _, i := range importsOf(root) {
+			walk(root.Dir, i)
 		}
 	}
+	return srcs
+}
+
+// loadDependencies walks the imports of srcs (and their imports, and so
+// on) and appends the *build.Package for each to srcs; see walkImports
+// for how each import path is resolved.
+func loadDependencies(ctx *kodos.Context, resolver kodos.Resolver, srcs ...*build.Package) []*build.Package {
+	seen := make(map[string]bool, len(srcs))
 	for _, src := range srcs {
 		seen[src.ImportPath] = true
 	}
-	for _, src := range srcs[:] {
-		for _, i := range src.Imports {
-			walk(i)
-		}
+	return walkImports(ctx, resolver, seen, srcs, srcs, func(pkg *build.Package) []string {
+		return pkg.Imports
+	})
+}
+
+// isRelativeImport reports whether path is a relative import, eg.
+// "./foo" or "../foo", as opposed to one rooted at GOROOT, a GOPATH
+// workspace, or a vendor directory.
+func isRelativeImport(path string) bool {
+	return path == "." || path == ".." || strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../")
+}
+
+// rewriteRelativeImport resolves a relative import against the
+// importing package's directory and rewrites it to the synthetic
+// "_/abs/path" form the go tool itself uses for local imports, so it can
+// flow through the same ImportPath-keyed machinery as everything else.
+// Imports that are not relative are returned unchanged.
+func rewriteRelativeImport(fromDir, path string) string {
+	if !isRelativeImport(path) {
+		return path
 	}
-	return srcs
+	abs, err := filepath.Abs(filepath.Join(fromDir, path))
+	if err != nil {
+		fatal("cannot resolve relative import ", path, err.Error())
+	}
+	return "_" + filepath.ToSlash(abs)
 }
 
-func register(rootdir, prefix, kind, arg string, next func(string) *build.Package) func(string) *build.Package {
-	dir := cacheDir(rootdir, prefix+kind+"="+arg)
-	fmt.Println("registered:", prefix, "@", arg)
-	return func(path string) *build.Package {
-		if !strings.HasPrefix(path, prefix) {
-			return next(path)
-		}
-		fmt.Println("searching", path, "in", prefix, "@", arg)
-		dir := filepath.Join(dir, path)
-		_, err := os.Stat(dir)
-		if os.IsNotExist(err) {
-			check(err)
-		}
-		return importPath(path, dir)
+// resolveImport resolves path (already passed through
+// rewriteRelativeImport) to its *build.Package. "C" is cgo's
+// pseudo-import, added to Package.Imports for any file with a cgo
+// preprocessor directive; it names no real source directory, so it
+// resolves to an empty placeholder rather than being hunted for by
+// resolver -- kodos.Package's IsStale and BuildPackages already
+// special-case the "C" import path, so it is never compiled. A
+// synthetic "_/abs/path" relative import names its own directory
+// directly; anything else is handed to resolver.
+func resolveImport(ctx *kodos.Context, resolver kodos.Resolver, fromDir, path string) (*build.Package, error) {
+	if path == "C" {
+		return &build.Package{ImportPath: "C"}, nil
+	}
+	if strings.HasPrefix(path, "_/") {
+		return importPath(ctx, path, filepath.FromSlash(strings.TrimPrefix(path, "_"))), nil
 	}
+	return resolver.Resolve(fromDir, path)
 }
 
-func importPath(path, dir string) *build.Package {
-	pkg, err := build.ImportDir(dir, 0)
+// loadTestDependencies is loadDependencies plus the packages reachable
+// only via srcs' TestImports/XTestImports -- the extra dependencies test
+// files themselves pull in (eg. "testing") that a plain build never
+// needs to resolve.
+func loadTestDependencies(ctx *kodos.Context, resolver kodos.Resolver, srcs ...*build.Package) []*build.Package {
+	roots := srcs
+	srcs = loadDependencies(ctx, resolver, srcs...)
+
+	seen := make(map[string]bool, len(srcs))
+	for _, src := range srcs {
+		seen[src.ImportPath] = true
+	}
+	return walkImports(ctx, resolver, seen, srcs, roots, func(pkg *build.Package) []string {
+		return append(append([]string(nil), pkg.TestImports...), pkg.XTestImports...)
+	})
+}
+
+func importPath(ctx *kodos.Context, path, dir string) *build.Package {
+	pkg, err := ctx.ImportDir(dir)
 	check(err)
 	// ImportDir does not know the import path for this package
 	// but we know the prefix, so fix it.
 	pkg.ImportPath = path
 	return pkg
 }
-
-func cacheDir(rootdir, key string) string {
-	hash := sha1.Sum([]byte(key))
-	return filepath.Join(rootdir, ".kang", "cache", fmt.Sprintf("%x", hash[0:1]), fmt.Sprintf("%x", hash[1:]))
-}
@@ -1,6 +1,7 @@
 package kodos
 
 import (
+	"bytes"
 	"fmt"
 	"go/build"
 	"io"
@@ -24,9 +25,32 @@ type Context struct {
 	gcflags      []string // -gcflags
 	ldflags      []string // -ldflags
 	buildtags    []string
+	buildJobs    int // max concurrent compiles, 0 means runtime.NumCPU()
 }
 
-func (c *Context) isCrossCompile() bool { return false }
+// njobs returns the maximum number of packages BuildPackages should
+// compile at once.
+func (c *Context) njobs() int {
+	if c.buildJobs > 0 {
+		return c.buildJobs
+	}
+	return runtime.NumCPU()
+}
+
+// isCrossCompile reports whether the target GOOS/GOARCH of this Context
+// differ from the host's, and therefore whether compile/link/asm need to
+// be told, via the environment, to produce object code for a foreign
+// platform rather than the one kodos itself is running on.
+func (c *Context) isCrossCompile() bool {
+	return c.GOOS != runtime.GOOS || c.GOARCH != runtime.GOARCH
+}
+
+// targetEnv returns the GOOS/GOARCH environment kodos must set on
+// compile/link/asm subprocesses so they target c.GOOS/c.GOARCH instead of
+// defaulting to the host's.
+func (c *Context) targetEnv() []string {
+	return append(os.Environ(), "GOOS="+c.GOOS, "GOARCH="+c.GOARCH)
+}
 
 func (c *Context) searchPaths() []string {
 	return []string{
@@ -35,6 +59,26 @@ func (c *Context) searchPaths() []string {
 	}
 }
 
+// buildContext returns a go/build.Context configured for this Context's
+// target platform and build tags, so package loading honors `// +build`
+// constraints for the platform kodos is actually building for, rather
+// than the one the kodos binary itself happens to be running on.
+func (c *Context) buildContext() *build.Context {
+	bctx := build.Default
+	bctx.GOOS = c.GOOS
+	bctx.GOARCH = c.GOARCH
+	bctx.BuildTags = c.buildtags
+	return &bctx
+}
+
+// ImportDir is like go/build's ImportDir, but selects files the way this
+// Context's GOOS/GOARCH/BuildTags dictate rather than the host's, so
+// cross-compiled and tag-gated packages see the same GoFiles/CgoFiles
+// split `go build` would choose for that target.
+func (c *Context) ImportDir(dir string) (*build.Package, error) {
+	return c.buildContext().ImportDir(dir, 0)
+}
+
 // ctxString returns a string representation of the unique properties
 // of the context.
 func (c *Context) ctxString() string {
@@ -54,6 +98,12 @@ type Package struct {
 	testScope bool // is a test scoped package
 	Main      bool // this is a command
 	NotStale  bool // this package _and_ all its dependencies are not stale
+
+	xtestPkg    *Package // external "_test" package, if any; test scope only
+	testmainPkg *Package // generated command that runs xtestPkg/this package's tests; test scope only
+
+	log           bytes.Buffer // buffered Compile output, drained once complete
+	cachedBuildID string       // memoised result of buildID
 }
 
 const debug = true
@@ -122,6 +172,18 @@ func (pkg *Package) IsStale() bool {
 		return true
 	}
 
+	if pkg.Goroot && (!pkg.isCrossCompile() || exists(pkg.gorootPrebuilt())) {
+		// pkg.pkgpath() is a precompiled standard library -- the host's
+		// own, or (for a cross-compile) one the host toolchain already
+		// carries for the target -- and carries no kodos buildID to
+		// compare against, so the mtime checks above are all we get, and
+		// its mere existence is enough.
+		return false
+	}
+
+	// Fast pre-check: a source file newer than the built .a conclusively
+	// proves staleness without paying for a buildID, which has to read
+	// and hash every source file plus recurse into every import.
 	for _, src := range pkg.files() {
 		if olderThan(filepath.Join(pkg.Dir, src)) {
 			debugf("%s is older than %s", pkg.pkgpath(), filepath.Join(pkg.Dir, src))
@@ -129,28 +191,82 @@ func (pkg *Package) IsStale() bool {
 		}
 	}
 
+	// The mtime check above cannot prove the converse, though: it can
+	// false positive as "not stale" on a fresh git clone or vendored
+	// checkout, where every file gets the same mtime regardless of
+	// whether its content actually changed. The authoritative answer
+	// comes from comparing the package's content hash against the one
+	// recorded when pkg.pkgpath() was last built.
+	id, err := pkg.buildID()
+	if err != nil {
+		debugf("%s: could not compute build id: %v", pkg.ImportPath, err)
+		return true
+	}
+	stored, ok := pkg.storedBuildID()
+	if !ok || stored != id {
+		debugf("%s build id %q does not match stored %q", pkg.ImportPath, id, stored)
+		return true
+	}
+
 	return false
 }
 
-// files returns all source files in scope
+// files returns all source files that contribute to this package's
+// compiled output, for hashing by buildID: plain Go sources, assembly
+// sources and headers, plus the cgo preprocessor's inputs, which are just
+// as capable of changing what gets compiled.
 func (p *Package) files() []string {
-	return stringList(p.GoFiles)
+	return stringList(p.GoFiles, p.SFiles, p.HFiles, p.CgoFiles, p.CFiles)
+}
+
+// gorootPrebuilt returns the path to the host toolchain's own
+// precompiled copy of this standard library package for pkg.GOOS/
+// pkg.GOARCH, whether that's the host's native platform or one it was
+// cross-compiled for ahead of time (eg. after `go install std`).
+func (pkg *Package) gorootPrebuilt() string {
+	importpath := filepath.FromSlash(pkg.ImportPath) + ".a"
+	return filepath.Join(runtime.GOROOT(), "pkg", pkg.GOOS+"_"+pkg.GOARCH, importpath)
 }
 
 // pkgpath returns the destination for object cached for this Package.
 func (pkg *Package) pkgpath() string {
 	importpath := filepath.FromSlash(pkg.ImportPath) + ".a"
 	switch {
-	case pkg.isCrossCompile():
-		return filepath.Join(pkg.Pkgdir, importpath)
+	case pkg.testScope:
+		// never installed, and must shadow any non-test .a for the same
+		// import path, so it lives under Workdir, which searchPaths()
+		// always checks first.
+		return filepath.Join(pkg.Workdir, importpath)
 	case pkg.race:
 		// race enabled standard lib
 		return filepath.Join(runtime.GOROOT(), "pkg", pkg.GOOS+"_"+pkg.GOARCH+"_race", importpath)
+	case pkg.Goroot && !pkg.isCrossCompile():
+		// host's precompiled standard library
+		return pkg.gorootPrebuilt()
+	case pkg.Goroot && pkg.isCrossCompile():
+		// the host toolchain may already carry a precompiled standard
+		// library for the target platform (eg. after `go install std`);
+		// prefer it, falling back to building the stdlib ourselves into
+		// Pkgdir otherwise. installpath() returns that same Pkgdir path
+		// for every cross compile, so a package we actually compile is
+		// cached and found at the same path on the next run.
+		if exists(pkg.gorootPrebuilt()) {
+			return pkg.gorootPrebuilt()
+		}
+		return filepath.Join(pkg.Pkgdir, pkg.GOOS+"_"+pkg.GOARCH, importpath)
+	case pkg.isCrossCompile():
+		return filepath.Join(pkg.Pkgdir, pkg.GOOS+"_"+pkg.GOARCH, importpath)
 	default:
 		return filepath.Join(pkg.Pkgdir, importpath)
 	}
 }
 
+// exists reports whether path can be stat'd.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 // Binfile returns the destination of the compiled target of this command.
 func (pkg *Package) Binfile() string {
 	// TODO(dfc) should have a check for package main, or should be merged in to objfile.
@@ -175,7 +291,7 @@ func (pkg *Package) Binfile() string {
 func (pkg *Package) binname() string {
 	switch {
 	case pkg.testScope:
-		return pkg.name() + ".test"
+		return filepath.Base(filepath.FromSlash(pkg.ImportPath)) + ".test"
 	case pkg.Main:
 		return filepath.Base(filepath.FromSlash(pkg.ImportPath))
 	default:
@@ -188,12 +304,33 @@ func (p *Package) complete() bool {
 	case "bytes", "net", "os", "runtime/pprof", "sync", "time":
 		return false
 	default:
-		return len(p.SFiles) == 0 // no cgo or runtime code
+		return len(p.SFiles) == 0 && len(p.CgoFiles) == 0 // no cgo or runtime code
 	}
 }
 
 func (p *Package) name() string { return filepath.FromSlash(p.ImportPath) }
 
+// drainLog writes any output buffered by Compile to stderr in one go
+// (Link writes straight to stdout/stderr). Packages are only ever compiled by a single goroutine at a time, so
+// draining after the fact (rather than writing straight to stderr from
+// the subprocess) keeps concurrent builds from interleaving their output.
+func (pkg *Package) drainLog() {
+	if pkg.log.Len() == 0 {
+		return
+	}
+	os.Stderr.Write(pkg.log.Bytes())
+	pkg.log.Reset()
+}
+
+// ccCompiler returns the C compiler to use for a package's cgo sources:
+// $CC if set, otherwise "gcc" on every platform.
+func ccCompiler() string {
+	if cc := os.Getenv("CC"); cc != "" {
+		return cc
+	}
+	return "gcc"
+}
+
 func stringList(args ...[]string) []string {
 	var l []string
 	for _, arg := range args {
@@ -203,28 +340,86 @@ func stringList(args ...[]string) []string {
 }
 
 func (pkg *Package) Compile() error {
+	defer pkg.drainLog()
+
 	var gofiles []string
 	gofiles = append(gofiles, pkg.GoFiles...)
-	if len(gofiles) == 0 {
-		return fmt.Errorf("compile %q: no go files supplied", pkg.ImportPath)
-	}
 	ofiles := []string{pkg.objfile()}
 
 	run := func(dir, tool string, args ...string) error {
 		cmd := exec.Command(filepath.Join(runtime.GOROOT(), "pkg", "tool", runtime.GOOS+"_"+runtime.GOARCH, tool), args...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		cmd.Stdout = &pkg.log
+		cmd.Stderr = &pkg.log
 		cmd.Dir = dir
-		fmt.Fprintf(os.Stderr, "+ %s\n", strings.Join(cmd.Args, " "))
+		cmd.Env = pkg.targetEnv()
+		fmt.Fprintf(&pkg.log, "+ %s\n", strings.Join(cmd.Args, " "))
+		return cmd.Run()
+	}
+
+	cc := func(outfile, infile string, includedirs ...string) error {
+		args := []string{"-c", "-o", outfile}
+		for _, d := range includedirs {
+			args = append(args, "-I", d)
+		}
+		args = append(args, infile)
+		cmd := exec.Command(ccCompiler(), args...)
+		cmd.Stdout = &pkg.log
+		cmd.Stderr = &pkg.log
+		cmd.Dir = pkg.Dir
+		fmt.Fprintf(&pkg.log, "+ %s\n", strings.Join(cmd.Args, " "))
 		return cmd.Run()
 	}
 
+	// cgo preprocesses pkg.CgoFiles into plain Go and C source written
+	// into objdir, following cgo's own naming scheme: "foo.go" becomes
+	// "foo.cgo1.go" (Go) and "foo.cgo2.c" (C), plus a couple of files
+	// (_cgo_gotypes.go, _cgo_export.c) shared across the whole package.
+	// It returns the generated Go files to compile alongside gofiles and
+	// the object files produced by compiling the generated (and any
+	// plain) C sources, to be packed in alongside the assembled ones.
+	cgo := func(pkg *Package) (gofiles, ofiles []string, err error) {
+		objdir := filepath.Join(pkg.Workdir, "_cgo", pkg.pkgname())
+		if err := mkdir(objdir); err != nil {
+			return nil, nil, err
+		}
+
+		args := append([]string{"-objdir", objdir}, pkg.CgoFiles...)
+		if err := run(pkg.Dir, "cgo", args...); err != nil {
+			return nil, nil, err
+		}
+
+		gofiles = append(gofiles, filepath.Join(objdir, "_cgo_gotypes.go"))
+		cfiles := append([]string(nil), pkg.CFiles...)
+		cfiles = append(cfiles, filepath.Join(objdir, "_cgo_export.c"))
+		for _, f := range pkg.CgoFiles {
+			base := strings.TrimSuffix(f, ".go")
+			gofiles = append(gofiles, filepath.Join(objdir, base+".cgo1.go"))
+			cfiles = append(cfiles, filepath.Join(objdir, base+".cgo2.c"))
+		}
+
+		includedir := filepath.Join(runtime.GOROOT(), "pkg", "include")
+		for _, f := range cfiles {
+			o := filepath.Join(objdir, strings.TrimSuffix(filepath.Base(f), ".c")+".o")
+			if err := cc(o, f, pkg.Dir, objdir, includedir); err != nil {
+				return nil, nil, err
+			}
+			ofiles = append(ofiles, o)
+		}
+		return gofiles, ofiles, nil
+	}
+
 	gc := func(pkg *Package) error {
 		args := append(pkg.gcflags, "-p", pkg.ImportPath)
 		args = append(args, "-o", ofiles[0])
 		for _, d := range pkg.searchPaths() {
 			args = append(args, "-I", d)
 		}
+		if strings.HasPrefix(pkg.ImportPath, "_/") {
+			// a relative ("./foo") import, rewritten to its synthetic
+			// "_/abs/path" form; tell the compiler what directory that
+			// placeholder really names.
+			args = append(args, "-D", filepath.FromSlash(strings.TrimPrefix(pkg.ImportPath, "_")))
+		}
 		if pkg.ImportPath == "runtime" {
 			// runtime compiles with a special gc flag to emit
 			// additional reflect type data.
@@ -243,7 +438,7 @@ func (pkg *Package) Compile() error {
 
 	asm := func(pkg *Package, ofile, sfile string) error {
 		ofiles = append(ofiles, ofile)
-		args := []string{"-o", ofile, "-D", "GOOS_" + runtime.GOOS, "-D", "GOARCH_" + runtime.GOARCH}
+		args := []string{"-o", ofile, "-D", "GOOS_" + pkg.GOOS, "-D", "GOARCH_" + pkg.GOARCH}
 		odir := filepath.Join(filepath.Dir(ofile))
 		includedir := filepath.Join(runtime.GOROOT(), "pkg", "include")
 		args = append(args, "-I", odir, "-I", includedir)
@@ -260,6 +455,17 @@ func (pkg *Package) Compile() error {
 	if err := mkdir(filepath.Dir(pkg.pkgpath())); err != nil {
 		return err
 	}
+	if len(pkg.CgoFiles) > 0 {
+		cgogofiles, cgoofiles, err := cgo(pkg)
+		if err != nil {
+			return fmt.Errorf("cgo %s: %v", pkg.ImportPath, err)
+		}
+		gofiles = append(gofiles, cgogofiles...)
+		ofiles = append(ofiles, cgoofiles...)
+	}
+	if len(gofiles) == 0 {
+		return fmt.Errorf("compile %q: no go files supplied", pkg.ImportPath)
+	}
 	if err := gc(pkg); err != nil {
 		return nil
 	}
@@ -273,7 +479,10 @@ func (pkg *Package) Compile() error {
 			return err
 		}
 	}
-	return copyfile(pkg.installpath(), ofiles[0])
+	if err := copyfile(pkg.installpath(), ofiles[0]); err != nil {
+		return err
+	}
+	return pkg.writeBuildID()
 }
 
 func (pkg *Package) Link() error {
@@ -296,6 +505,7 @@ func (pkg *Package) Link() error {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Dir = pkg.Workdir
+	cmd.Env = pkg.targetEnv()
 	fmt.Fprintf(os.Stderr, "+ %s\n", strings.Join(cmd.Args, " "))
 	if err := cmd.Run(); err != nil {
 		os.Remove(tmp.Name()) // remove partial file
@@ -332,10 +542,17 @@ func (pkg *Package) pkgname() string {
 // project's pkg/ directory in the case that the stdlib is out of date, or not compiled for
 // a specific architecture.
 func (pkg *Package) installpath() string {
-	if pkg.testScope {
-		panic("installpath called with test scope")
+	importpath := filepath.FromSlash(pkg.ImportPath) + ".a"
+	switch {
+	case pkg.testScope:
+		// test packages are rebuilt every run and never cached; install
+		// to the same Workdir location pkgpath() expects them at.
+		return filepath.Join(pkg.Workdir, importpath)
+	case pkg.isCrossCompile():
+		return filepath.Join(pkg.Pkgdir, pkg.GOOS+"_"+pkg.GOARCH, importpath)
+	default:
+		return filepath.Join(pkg.Pkgdir, importpath)
 	}
-	return filepath.Join(pkg.Pkgdir, filepath.FromSlash(pkg.ImportPath)+".a")
 }
 
 func mkdir(path string) error {
@@ -0,0 +1,159 @@
+package kodos
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Resolver resolves an import path to the *build.Package that provides
+// it. fromDir is the directory of the package doing the importing, so
+// implementations that care about locality -- a vendor resolver walking
+// up to the nearest ancestor vendor/ directory -- can do so; callers
+// that don't need it are free to ignore it. Implementations are free to
+// look anywhere -- a source tree, a vendor directory, GOROOT, a
+// fetched-module cache -- and are normally combined with ChainResolvers
+// so callers can extend kodos to whatever layout their repository uses
+// without forking loadDependencies itself.
+type Resolver interface {
+	Resolve(fromDir, importPath string) (*build.Package, error)
+}
+
+// ResolverFunc adapts a plain function to a Resolver.
+type ResolverFunc func(fromDir, importPath string) (*build.Package, error)
+
+func (f ResolverFunc) Resolve(fromDir, importPath string) (*build.Package, error) {
+	return f(fromDir, importPath)
+}
+
+// ChainResolvers is a Resolver that tries each of its members in turn,
+// in order, returning the first successful resolution. If every member
+// fails, the error from the last one is returned.
+type ChainResolvers []Resolver
+
+func (c ChainResolvers) Resolve(fromDir, importPath string) (*build.Package, error) {
+	var err error
+	for _, r := range c {
+		var pkg *build.Package
+		if pkg, err = r.Resolve(fromDir, importPath); err == nil {
+			return pkg, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("%s: no resolver configured", importPath)
+	}
+	return nil, err
+}
+
+// NewSourceResolver returns a Resolver that resolves import paths
+// beneath prefix to their directory inside the repository's own source
+// tree rooted at dir, eg. prefix "github.com/foo/bar" with dir
+// "/repo" resolves "github.com/foo/bar/baz" to "/repo/baz". Files are
+// selected for ctx's GOOS/GOARCH/BuildTags.
+func NewSourceResolver(ctx *Context, prefix, dir string) Resolver {
+	return ResolverFunc(func(fromDir, importPath string) (*build.Package, error) {
+		if !strings.HasPrefix(importPath, prefix) {
+			return nil, fmt.Errorf("%s: not under %s", importPath, prefix)
+		}
+		rel := filepath.FromSlash(strings.TrimPrefix(importPath, prefix))
+		return importDir(ctx, importPath, filepath.Join(dir, rel))
+	})
+}
+
+// NewVendorResolver returns a Resolver that resolves import paths
+// against the nearest vendor/ directory at or above fromDir, stopping at
+// rootdir (the repository root) when fromDir lies beneath it and at the
+// filesystem root otherwise, eg. a package in
+// "/repo/sub" with a "/repo/sub/vendor/golang.org/x/foo" directory
+// resolves "golang.org/x/foo" there even though "/repo/vendor" also
+// exists, matching the go tool's own nearest-vendor-wins rule. Files
+// are selected for ctx's GOOS/GOARCH/BuildTags.
+func NewVendorResolver(ctx *Context, rootdir string) Resolver {
+	return ResolverFunc(func(fromDir, importPath string) (*build.Package, error) {
+		for dir := fromDir; ; {
+			vendor := filepath.Join(dir, "vendor", filepath.FromSlash(importPath))
+			if fi, err := os.Stat(vendor); err == nil && fi.IsDir() {
+				return importDir(ctx, importPath, vendor)
+			}
+			if dir == rootdir {
+				break
+			}
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+		return nil, fmt.Errorf("%s: not vendored under %s", importPath, rootdir)
+	})
+}
+
+// NewGOPATHResolver returns a Resolver that resolves import paths
+// against each workspace in build.Default.GOPATH in turn, eg.
+// "golang.org/x/foo" resolves to "$GOPATH/src/golang.org/x/foo". Files
+// are selected for ctx's GOOS/GOARCH/BuildTags.
+func NewGOPATHResolver(ctx *Context) Resolver {
+	return ResolverFunc(func(fromDir, importPath string) (*build.Package, error) {
+		for _, gopath := range filepath.SplitList(build.Default.GOPATH) {
+			if gopath == "" {
+				continue
+			}
+			dir := filepath.Join(gopath, "src", filepath.FromSlash(importPath))
+			if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+				return importDir(ctx, importPath, dir)
+			}
+		}
+		return nil, fmt.Errorf("%s: not found in any GOPATH workspace", importPath)
+	})
+}
+
+// NewGorootResolver returns a Resolver that resolves import paths
+// against the standard library under runtime.GOROOT(), selecting files
+// for ctx's GOOS/GOARCH/BuildTags.
+func NewGorootResolver(ctx *Context) Resolver {
+	goroot := runtime.GOROOT()
+	return ResolverFunc(func(fromDir, importPath string) (*build.Package, error) {
+		dir := filepath.Join(goroot, "src", filepath.FromSlash(importPath))
+		return importDir(ctx, importPath, dir)
+	})
+}
+
+// NewCacheResolver returns a Resolver that resolves import paths beneath
+// prefix to their directory inside a content-addressed cache under
+// rootdir, keyed by sha1(prefix+kind+"="+arg) -- eg. kind "git" and arg a
+// commit hash, so that two fetches of the same revision share a cache
+// entry regardless of how they were fetched. Files are selected for
+// ctx's GOOS/GOARCH/BuildTags.
+func NewCacheResolver(ctx *Context, rootdir, prefix, kind, arg string) Resolver {
+	dir := cacheDir(rootdir, prefix+kind+"="+arg)
+	return ResolverFunc(func(fromDir, importPath string) (*build.Package, error) {
+		if !strings.HasPrefix(importPath, prefix) {
+			return nil, fmt.Errorf("%s: not under %s", importPath, prefix)
+		}
+		rel := filepath.FromSlash(strings.TrimPrefix(importPath, prefix))
+		return importDir(ctx, importPath, filepath.Join(dir, rel))
+	})
+}
+
+// cacheDir returns the content-addressed cache directory for key,
+// beneath rootdir/.kang/cache, split into a two-level directory so no
+// single directory ends up holding an unreasonable number of entries.
+func cacheDir(rootdir, key string) string {
+	hash := sha1.Sum([]byte(key))
+	return filepath.Join(rootdir, ".kang", "cache", fmt.Sprintf("%x", hash[0:1]), fmt.Sprintf("%x", hash[1:]))
+}
+
+// importDir loads the package at dir via ctx.ImportDir and fixes up its
+// ImportPath, which ImportDir has no way to know.
+func importDir(ctx *Context, importPath, dir string) (*build.Package, error) {
+	pkg, err := ctx.ImportDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	pkg.ImportPath = importPath
+	return pkg, nil
+}
@@ -0,0 +1,348 @@
+package kodos
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// TransformTests returns, for each package in roots that has internal or
+// external Go test files, a testScope *Package ready to be handed to
+// BuildTests: its TestGoFiles are merged into the package itself, its
+// XTestGoFiles (if any) become a sibling "_test" package, and a
+// generated testmain command, enumerating every Test/Benchmark/Example
+// function in both, is written out and wired up to link against them.
+//
+// all must contain a transformed *Package, via Context.Transform, for
+// every import path reachable from roots -- including each root's
+// TestImports and XTestImports -- so that test-only dependencies (eg.
+// "testing" itself) can be resolved.
+func (ctx *Context) TransformTests(all []*Package, roots ...*Package) []*Package {
+	index := make(map[string]*Package, len(all))
+	for _, pkg := range all {
+		index[pkg.ImportPath] = pkg
+	}
+
+	resolve := func(paths []string) []*Package {
+		var deps []*Package
+		for _, path := range paths {
+			dep, ok := index[path]
+			if !ok {
+				panic(fmt.Sprintln("TransformTests: pkg", path, "is not loaded"))
+			}
+			deps = append(deps, dep)
+		}
+		return deps
+	}
+
+	var tests []*Package
+	for _, pkg := range roots {
+		if len(pkg.TestGoFiles) == 0 && len(pkg.XTestGoFiles) == 0 {
+			continue
+		}
+		test, err := ctx.transformTest(pkg, resolve)
+		if err != nil {
+			panic(fmt.Sprintln("TransformTests:", pkg.ImportPath, err))
+		}
+		tests = append(tests, test)
+	}
+
+	var everything []*Package
+	for _, test := range tests {
+		everything = append(everything, test)
+		if test.xtestPkg != nil {
+			everything = append(everything, test.xtestPkg)
+		}
+		everything = append(everything, test.testmainPkg)
+	}
+	computeStale(everything...)
+
+	return tests
+}
+
+// transformTest builds the internal test package, optional external test
+// package, and generated testmain command for a single package under
+// test.
+func (ctx *Context) transformTest(pkg *Package, resolve func([]string) []*Package) (*Package, error) {
+	internal := *pkg.Package
+	internal.GoFiles = stringList(pkg.GoFiles, pkg.TestGoFiles)
+
+	test := &Package{
+		Context:   ctx,
+		Package:   &internal,
+		Imports:   append(append([]*Package(nil), pkg.Imports...), resolve(pkg.TestImports)...),
+		testScope: true,
+	}
+
+	if len(pkg.XTestGoFiles) > 0 {
+		external := *pkg.Package
+		external.Name = pkg.Name + "_test"
+		external.ImportPath = pkg.ImportPath + "_test"
+		external.GoFiles = pkg.XTestGoFiles
+
+		test.xtestPkg = &Package{
+			Context:   ctx,
+			Package:   &external,
+			Imports:   append(append([]*Package(nil), pkg.Imports...), append(resolve(pkg.XTestImports), test)...),
+			testScope: true,
+		}
+	}
+
+	testmain, err := ctx.generateTestmain(pkg, test)
+	if err != nil {
+		return nil, err
+	}
+	test.testmainPkg = testmain
+
+	return test, nil
+}
+
+var testFuncRe = regexp.MustCompile(`^(Test|Benchmark|Example)([^a-z].*)?$`)
+
+// testFunc names a single Test/Benchmark/Example/TestMain function
+// discovered by discoverTestFuncs, qualified by the package (alias) that
+// declares it.
+type testFunc struct {
+	Kind      string // "Test", "Benchmark", "Example" or "TestMain"
+	Alias     string // import alias of the declaring package: "pkg" or "pkg_test"
+	Name      string
+	Output    string // Example only: expected "// Output:" text
+	Unordered bool   // Example only: expected output order doesn't matter
+	HasOutput bool   // Example only: an Output/Unordered comment was present
+}
+
+// isTestMainFunc reports whether fn has the one signature `go test`
+// treats as the package's own test entrypoint: func(*testing.M).
+func isTestMainFunc(fn *ast.FuncDecl) bool {
+	params := fn.Type.Params.List
+	if len(params) != 1 || len(params[0].Names) > 1 {
+		return false
+	}
+	star, ok := params[0].Type.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := star.X.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	return ok && pkg.Name == "testing" && sel.Sel.Name == "M"
+}
+
+// discoverTestFuncs parses files (in dir) and returns every top level
+// Test/Benchmark/Example function they declare, in the same manner `go
+// test` itself discovers them, plus a TestMain(m *testing.M) if one is
+// present in place of a "Test".
+func discoverTestFuncs(dir string, files []string, alias string) ([]testFunc, error) {
+	var out []testFunc
+	fset := token.NewFileSet()
+	for _, f := range files {
+		file, err := parser.ParseFile(fset, filepath.Join(dir, f), nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		examples := make(map[string]*doc.Example)
+		for _, ex := range doc.Examples(file) {
+			examples["Example"+ex.Name] = ex
+		}
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil {
+				continue
+			}
+			m := testFuncRe.FindStringSubmatch(fn.Name.Name)
+			if m == nil {
+				continue
+			}
+			kind := m[1]
+			if fn.Name.Name == "TestMain" && isTestMainFunc(fn) {
+				kind = "TestMain"
+			}
+			tf := testFunc{Kind: kind, Alias: alias, Name: fn.Name.Name}
+			if kind == "Example" {
+				if ex, ok := examples[fn.Name.Name]; ok {
+					tf.Output, tf.Unordered = ex.Output, ex.Unordered
+					tf.HasOutput = ex.Output != "" || ex.EmptyOutput
+				}
+			}
+			out = append(out, tf)
+		}
+	}
+	return out, nil
+}
+
+var testmainTmpl = template.Must(template.New("testmain").Parse(`// generated by kodos; do not edit
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	{{.PkgAlias}} {{printf "%q" .ImportPath}}
+{{if .XImportPath}}	{{.XPkgAlias}} {{printf "%q" .XImportPath}}
+{{end}})
+
+var tests = []testing.InternalTest{
+{{range .Tests}}	{"{{.Name}}", {{.Alias}}.{{.Name}}},
+{{end}}}
+
+var benchmarks = []testing.InternalBenchmark{
+{{range .Benchmarks}}	{"{{.Name}}", {{.Alias}}.{{.Name}}},
+{{end}}}
+
+var examples = []testing.InternalExample{
+{{range .Examples}}	{Name: "{{.Name}}", F: {{.Alias}}.{{.Name}}, Output: {{printf "%q" .Output}}, Unordered: {{.Unordered}}},
+{{end}}}
+
+func main() {
+{{if .TestMain}}	m := testing.MainStart(regexp.MatchString, tests, benchmarks, examples)
+	{{.TestMain.Alias}}.{{.TestMain.Name}}(m)
+{{else}}	testing.Main(regexp.MatchString, tests, benchmarks, examples)
+{{end}}}
+`))
+
+// generateTestmain discovers the Test/Benchmark/Example functions of pkg
+// (internal and, if present, external) and writes the resulting
+// _testmain.go into a scratch directory under Workdir, returning the
+// *Package that compiles and links it into the final test binary.
+func (ctx *Context) generateTestmain(pkg *Package, test *Package) (*Package, error) {
+	funcs, err := discoverTestFuncs(pkg.Dir, pkg.TestGoFiles, "pkg")
+	if err != nil {
+		return nil, err
+	}
+
+	xImportPath := ""
+	if test.xtestPkg != nil {
+		xfuncs, err := discoverTestFuncs(pkg.Dir, pkg.XTestGoFiles, "pkg_test")
+		if err != nil {
+			return nil, err
+		}
+		funcs = append(funcs, xfuncs...)
+		xImportPath = test.xtestPkg.ImportPath
+	}
+
+	data := struct {
+		ImportPath                  string
+		XImportPath                 string
+		Tests, Benchmarks, Examples []testFunc
+		TestMain                    *testFunc
+		PkgAlias, XPkgAlias         string // "_" unless a function above refers to it
+	}{
+		ImportPath:  pkg.ImportPath,
+		XImportPath: xImportPath,
+		PkgAlias:    "_",
+		XPkgAlias:   "_",
+	}
+	for _, f := range funcs {
+		f := f
+		switch f.Kind {
+		case "Test":
+			data.Tests = append(data.Tests, f)
+		case "Benchmark":
+			data.Benchmarks = append(data.Benchmarks, f)
+		case "Example":
+			if !f.HasOutput {
+				// go test itself only runs Examples that declare an
+				// expected "// Output:"/"// Unordered output:" comment;
+				// anything else is parsed for godoc but never executed.
+				continue
+			}
+			data.Examples = append(data.Examples, f)
+		case "TestMain":
+			data.TestMain = &f
+		}
+		if f.Alias == "pkg" {
+			data.PkgAlias = "pkg"
+		} else {
+			data.XPkgAlias = "pkg_test"
+		}
+	}
+
+	dir := filepath.Join(pkg.Workdir, "_testmain", filepath.FromSlash(pkg.ImportPath))
+	if err := mkdir(dir); err != nil {
+		return nil, err
+	}
+
+	var buf strings.Builder
+	if err := testmainTmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "_testmain.go"), []byte(buf.String()), 0644); err != nil {
+		return nil, err
+	}
+
+	imports := []*Package{test}
+	if test.xtestPkg != nil {
+		imports = append(imports, test.xtestPkg)
+	}
+
+	return &Package{
+		Context: ctx,
+		Package: &build.Package{
+			Dir:        dir,
+			ImportPath: pkg.ImportPath + ".testmain",
+			Name:       "main",
+			GoFiles:    []string{"_testmain.go"},
+		},
+		Imports:   imports,
+		Main:      true,
+		testScope: true,
+	}, nil
+}
+
+// BuildTests compiles and links a test binary for each *Package returned
+// by TransformTests, then runs them one at a time, stopping at and
+// reporting the first failure encountered.
+func BuildTests(tests ...*Package) (func() error, error) {
+	var toBuild []*Package
+	for _, test := range tests {
+		toBuild = append(toBuild, test)
+		if test.xtestPkg != nil {
+			toBuild = append(toBuild, test.xtestPkg)
+		}
+		toBuild = append(toBuild, test.testmainPkg)
+	}
+
+	if _, err := BuildPackages(toBuild...); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		for _, test := range tests {
+			main := test.testmainPkg
+			if err := main.Link(); err != nil {
+				return fmt.Errorf("link %s: %v", test.ImportPath, err)
+			}
+			if err := runTest(test, main); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// runTest runs the linked test binary for test, with its working
+// directory set to the package under test's own directory, just as `go
+// test` does, so relative testdata paths resolve the same way.
+func runTest(test, main *Package) error {
+	cmd := exec.Command(main.Binfile())
+	cmd.Dir = test.Dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	fmt.Fprintf(os.Stderr, "+ %s\n", test.ImportPath)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", test.ImportPath, err)
+	}
+	return nil
+}